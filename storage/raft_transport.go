@@ -19,28 +19,25 @@ package storage
 
 import (
 	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/coreos/etcd/raft"
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/pkg/errors"
-	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/roachpb"
 	"github.com/cockroachdb/cockroach/rpc"
-	"github.com/cockroachdb/cockroach/util/log"
-	"github.com/cockroachdb/cockroach/util/retry"
+	"github.com/cockroachdb/cockroach/util/metric"
 	"github.com/cockroachdb/cockroach/util/syncutil"
-	"github.com/cockroachdb/cockroach/util/timeutil"
+	"github.com/cockroachdb/cockroach/util/uuid"
 )
 
 const (
-	// Outgoing messages are queued per-replica on a channel of this size.
-	raftSendBufferSize = 100
-
 	// When no message has been queued for this duration, the corresponding
-	// instance of processQueue will shut down.
+	// peer closes its streams and reconnects.
 	//
 	// TODO(tamird): make culling of outbound streams more evented, so that we
 	// need not rely on this timeout to shut things down.
@@ -66,55 +63,124 @@ func GossipAddressResolver(gossip *gossip.Gossip) NodeAddressResolver {
 	}
 }
 
-// RaftSnapshotStatus contains a MsgSnap message and its resulting
-// error, for asynchronous notification of completion.
+// RaftSnapshotStatus contains a MsgSnap message and its resulting error, for
+// asynchronous notification of completion. Size and Duration describe the
+// transfer that carried the snapshot, so that snapshot throughput per peer
+// can be tracked alongside the rest of RaftTransport's Stats.
+//
+// The consumer of SnapshotStatusChan is expected to report Outcome() back
+// to the sending replica's raft group via RawNode.ReportSnapshot, so that a
+// failed snapshot doesn't stall recovery of a lagging follower.
 type RaftSnapshotStatus struct {
-	Req *RaftMessageRequest
-	Err error
+	Req      *RaftMessageRequest
+	Err      error
+	Size     int64
+	Duration time.Duration
+}
+
+// Outcome translates s into the raft.SnapshotStatus that should be passed
+// to RawNode.ReportSnapshot for the range in s.Req.
+func (s RaftSnapshotStatus) Outcome() raft.SnapshotStatus {
+	if s.Err != nil {
+		return raft.SnapshotFailure
+	}
+	return raft.SnapshotFinish
+}
+
+// onPeerDownFunc is invoked by RaftTransport when it determines that a peer
+// is unreachable, so that raft can be told to stop wasting effort on it
+// (see RawNode.ReportUnreachable) rather than waiting for the next failed
+// Send to notice. The ReplicaDescriptor identifies the unreachable remote
+// replica; handlers are expected to ignore replicas they don't recognize.
+type onPeerDownFunc func(roachpb.ReplicaDescriptor)
+
+// Transport is the interface raft traffic moves over. RaftTransport is the
+// production implementation, backed by gRPC; InMemTransport is an
+// in-process loopback for tests that want deterministic message delivery
+// without the overhead and non-determinism of a real network stack. Store
+// depends only on Transport, never on RaftTransport directly, so that
+// alternative wire formats can be swapped in without touching call sites.
+type Transport interface {
+	// Listen registers handler and onPeerDown for storeID; see
+	// RaftTransport.Listen.
+	Listen(storeID roachpb.StoreID, handler raftMessageHandler, onPeerDown onPeerDownFunc)
+	// Stop unregisters storeID's handler and onPeerDownFunc.
+	Stop(storeID roachpb.StoreID)
+	// MakeSender constructs a RaftSender bound to this Transport.
+	MakeSender() RaftSender
+	// AddPeer registers toReplica as reachable via nodeID; see
+	// RaftTransport.AddPeer.
+	AddPeer(nodeID roachpb.NodeID, toReplica roachpb.ReplicaDescriptor)
+	// RemovePeer tears down the connection to nodeID, if any.
+	RemovePeer(nodeID roachpb.NodeID)
+	// SnapshotStatus returns the channel on which the outcome of every
+	// snapshot sent through this Transport is reported.
+	SnapshotStatus() <-chan RaftSnapshotStatus
 }
 
 // RaftTransport handles the rpc messages for raft.
 //
 // The raft transport is asynchronous with respect to the caller, and
-// internally multiplexes outbound messages. Internally, each message is
-// queued on a per-destination queue before being asynchronously delivered.
+// internally multiplexes outbound messages. Internally, each outbound
+// message is queued on a per-peer channel before being asynchronously
+// delivered.
 //
-// Callers are required to construct a RaftSender before being able to
-// dispatch messages, and must provide an error handler which will be invoked
-// asynchronously in the event that the recipient of any message closes its
-// inbound RPC stream. This callback is asynchronous with respect to the
-// outbound message which caused the remote to hang up; all that is known is
-// which remote hung up.
+// Peers are not lazily materialized by the first outbound message
+// addressed to them. Instead, callers explicitly register interest in a
+// peer via AddPeer before sending it anything, and tear it down via
+// RemovePeer; see the peer type for the connection lifecycle this drives.
 type RaftTransport struct {
 	resolver           NodeAddressResolver
 	rpcContext         *rpc.Context
 	SnapshotStatusChan chan RaftSnapshotStatus
 
+	metrics transportMetrics
+
+	// serverMsgsRcvd and serverBytesRcvd back ServerStats: the totals for
+	// this node as the receiving end of raft traffic, as opposed to the
+	// per-peer stats tracked for this node as a sender.
+	serverMsgsRcvd  int64
+	serverBytesRcvd int64
+
 	mu struct {
 		syncutil.Mutex
-		handlers    map[roachpb.StoreID]raftMessageHandler
-		queues      map[bool]map[roachpb.ReplicaDescriptor]chan *RaftMessageRequest
-		addrLookups map[roachpb.NodeID]chan struct{}
+		handlers         map[roachpb.StoreID]raftMessageHandler
+		peerDownHandlers map[roachpb.StoreID]onPeerDownFunc
+		peers            map[roachpb.NodeID]*peer
+		// pendingSnapshots tracks partially-received snapshots by UUID for
+		// the duration of the RaftSnapshot call receiving them; see
+		// pendingSnapshot.
+		pendingSnapshots map[uuid.UUID]*pendingSnapshot
+		// snapshotUUIDs assigns a stable UUID to each in-flight snapshot
+		// transfer, keyed by destination rather than minted fresh per call,
+		// so that a transferSnapshot retried after a dropped connection
+		// presents the same UUID as the attempt before it. See
+		// RaftTransport.snapshotUUID.
+		snapshotUUIDs map[snapshotTransferKey]uuid.UUID
 	}
 }
 
-// NewDummyRaftTransport returns a dummy raft transport for use in tests which
-// need a non-nil raft transport that need not function.
-func NewDummyRaftTransport() *RaftTransport {
-	return NewRaftTransport(nil, nil, nil)
-}
-
-// NewRaftTransport creates a new RaftTransport with specified resolver and grpc server.
-// Callers are responsible for monitoring RaftTransport.SnapshotStatusChan.
-func NewRaftTransport(resolver NodeAddressResolver, grpcServer *grpc.Server, rpcContext *rpc.Context) *RaftTransport {
+// NewRaftTransport creates a new RaftTransport with specified resolver and
+// grpc server. Per-peer and aggregate counters are registered with
+// registry, if non-nil. Callers are responsible for monitoring
+// RaftTransport.SnapshotStatusChan.
+func NewRaftTransport(
+	resolver NodeAddressResolver,
+	grpcServer *grpc.Server,
+	rpcContext *rpc.Context,
+	registry *metric.Registry,
+) *RaftTransport {
 	t := &RaftTransport{
 		resolver:           resolver,
 		rpcContext:         rpcContext,
 		SnapshotStatusChan: make(chan RaftSnapshotStatus),
+		metrics:            makeTransportMetrics(registry),
 	}
 	t.mu.handlers = make(map[roachpb.StoreID]raftMessageHandler)
-	t.mu.queues = make(map[bool]map[roachpb.ReplicaDescriptor]chan *RaftMessageRequest)
-	t.mu.addrLookups = make(map[roachpb.NodeID]chan struct{})
+	t.mu.peerDownHandlers = make(map[roachpb.StoreID]onPeerDownFunc)
+	t.mu.peers = make(map[roachpb.NodeID]*peer)
+	t.mu.pendingSnapshots = make(map[uuid.UUID]*pendingSnapshot)
+	t.mu.snapshotUUIDs = make(map[snapshotTransferKey]uuid.UUID)
 
 	if grpcServer != nil {
 		RegisterMultiRaftServer(grpcServer, t)
@@ -123,6 +189,21 @@ func NewRaftTransport(resolver NodeAddressResolver, grpcServer *grpc.Server, rpc
 	return t
 }
 
+var _ Transport = (*RaftTransport)(nil)
+
+// NewDummyRaftTransport returns a dummy raft transport for use in tests
+// which need a non-nil Transport that need not function. Prefer
+// InMemNetwork.NewTransport for tests that actually exercise message
+// delivery.
+func NewDummyRaftTransport() *RaftTransport {
+	return NewRaftTransport(nil, nil, nil, nil)
+}
+
+// SnapshotStatus implements Transport.
+func (t *RaftTransport) SnapshotStatus() <-chan RaftSnapshotStatus {
+	return t.SnapshotStatusChan
+}
+
 // RaftMessage proxies the incoming request to the listening server interface.
 func (t *RaftTransport) RaftMessage(stream MultiRaft_RaftMessageServer) (err error) {
 	errCh := make(chan error, 1)
@@ -137,6 +218,11 @@ func (t *RaftTransport) RaftMessage(stream MultiRaft_RaftMessageServer) (err err
 						return err
 					}
 
+					atomic.AddInt64(&t.serverMsgsRcvd, 1)
+					atomic.AddInt64(&t.serverBytesRcvd, int64(req.Size()))
+					t.metrics.MsgsRcvd.Inc(1)
+					t.metrics.BytesRcvd.Inc(int64(req.Size()))
+
 					t.mu.Lock()
 					handler, ok := t.mu.handlers[req.ToReplica.StoreID]
 					t.mu.Unlock()
@@ -165,150 +251,123 @@ func (t *RaftTransport) RaftMessage(stream MultiRaft_RaftMessageServer) (err err
 	}
 }
 
-// Listen registers a raftMessageHandler to receive proxied messages.
-func (t *RaftTransport) Listen(storeID roachpb.StoreID, handler raftMessageHandler) {
+// Listen registers a raftMessageHandler to receive proxied messages, and an
+// onPeerDownFunc that RaftTransport invokes whenever it determines that
+// some peer has become unreachable. storeID is expected to call
+// RawNode.ReportUnreachable for any of its local replicas' raft groups that
+// talk to the replica named by onPeerDown's argument.
+func (t *RaftTransport) Listen(storeID roachpb.StoreID, handler raftMessageHandler, onPeerDown onPeerDownFunc) {
 	t.mu.Lock()
 	t.mu.handlers[storeID] = handler
+	t.mu.peerDownHandlers[storeID] = onPeerDown
 	t.mu.Unlock()
 }
 
-// Stop unregisters a raftMessageHandler.
+// Stop unregisters a raftMessageHandler and its associated onPeerDownFunc.
 func (t *RaftTransport) Stop(storeID roachpb.StoreID) {
 	t.mu.Lock()
 	delete(t.mu.handlers, storeID)
+	delete(t.mu.peerDownHandlers, storeID)
 	t.mu.Unlock()
 }
 
-// This method handles backoff / retry for nodes which aren't being
-// communicated by gossip (yet -- as in the case of reconstituting a
-// cluster from copied data or after a long downtime)
-func (t *RaftTransport) resolveNodeID(nodeID roachpb.NodeID) (net.Addr, error) {
+// notifyPeerDown informs every registered onPeerDownFunc that toReplica has
+// become unreachable.
+func (t *RaftTransport) notifyPeerDown(toReplica roachpb.ReplicaDescriptor) {
 	t.mu.Lock()
-	ch, ok := t.mu.addrLookups[nodeID]
-	if !ok {
-		ch = make(chan struct{})
-		t.mu.addrLookups[nodeID] = ch
+	handlers := make([]onPeerDownFunc, 0, len(t.mu.peerDownHandlers))
+	for _, h := range t.mu.peerDownHandlers {
+		handlers = append(handlers, h)
 	}
 	t.mu.Unlock()
-	if ok {
-		select {
-		case <-ch:
-			return t.resolver(nodeID)
-		case <-t.rpcContext.Stopper.ShouldQuiesce():
-			return nil, errors.Errorf("address resolution for %s stopped before completion", nodeID)
-		}
-	}
 
-	defer func() {
-		t.mu.Lock()
-		delete(t.mu.addrLookups, nodeID)
-		t.mu.Unlock()
-	}()
-
-	opts := retry.Options{
-		InitialBackoff: InitialResolveBackoff,
-		MaxBackoff:     10 * time.Second,
-		Multiplier:     2,
-		Closer:         t.rpcContext.Stopper.ShouldQuiesce(),
-	}
-	for r := retry.Start(opts); r.Next(); {
-		addr, err := t.resolver(nodeID)
-		if err == nil {
-			close(ch)
-			if r.CurrentAttempt() > 0 {
-				log.Infof(context.TODO(), "address resolution for %s succeeded: %s", nodeID, addr)
-			}
-			return addr, nil
-		} else if r.CurrentAttempt() == 0 {
-			log.Warningf(context.TODO(), "failing address resolution for %s: %s", nodeID, err)
-		}
+	for _, h := range handlers {
+		h(toReplica)
 	}
-	return nil, errors.Errorf("address resolution for %s stopped before completion", nodeID)
 }
 
-// processQueue creates a client and sends messages from its designated queue
-// via that client, exiting when the client fails or when it idles out. All
-// messages remaining in the queue at that point are lost and a new instance of
-// processQueue should be started by the next message to be sent.
-// TODO(tschottdorf) should let raft know if the node is down;
-// need a feedback mechanism for that. Potentially easiest is to arrange for
-// the next call to Send() to fail appropriately.
-func (t *RaftTransport) processQueue(ch chan *RaftMessageRequest, toReplica roachpb.ReplicaDescriptor) error {
-	addr, err := t.resolveNodeID(toReplica.NodeID)
-	if err != nil {
-		return err
+// AddPeer registers toReplica as reachable via nodeID, creating and
+// starting the underlying peer connection if one does not already exist.
+// It is safe to call AddPeer more than once for the same nodeID, including
+// with differing values of toReplica: the peer tracks every replica it has
+// been told about so that a broken connection can later be attributed to
+// all of the ranges it affects.
+func (t *RaftTransport) AddPeer(nodeID roachpb.NodeID, toReplica roachpb.ReplicaDescriptor) {
+	t.mu.Lock()
+	p, ok := t.mu.peers[nodeID]
+	if !ok {
+		p = newPeer(t, nodeID)
+		t.mu.peers[nodeID] = p
 	}
+	t.mu.Unlock()
 
-	conn, err := t.rpcContext.GRPCDial(addr.String())
-	if err != nil {
-		return err
-	}
-	client := NewMultiRaftClient(conn)
+	p.addReplica(toReplica)
 
-	ctx, cancel := context.WithCancel(context.TODO())
-	defer cancel()
-	stream, err := client.RaftMessage(ctx)
-	if err != nil {
-		return err
+	if !ok {
+		p.start()
 	}
+}
 
-	errCh := make(chan error, 1)
+// RemovePeer tears down the peer connection to nodeID, if one exists. Any
+// messages still queued for delivery to it are discarded.
+func (t *RaftTransport) RemovePeer(nodeID roachpb.NodeID) {
+	t.mu.Lock()
+	p, ok := t.mu.peers[nodeID]
+	delete(t.mu.peers, nodeID)
+	t.mu.Unlock()
 
-	// Starting workers in a task prevents data races during shutdown.
-	if err := t.rpcContext.Stopper.RunTask(func() {
-		t.rpcContext.Stopper.RunWorker(func() {
-			errCh <- stream.RecvMsg(new(RaftMessageResponse))
-		})
-	}); err != nil {
-		return err
+	if ok {
+		p.stop()
 	}
+}
 
-	var raftIdleTimer timeutil.Timer
-	defer raftIdleTimer.Stop()
-	for {
-		raftIdleTimer.Reset(raftIdleTimeout)
-		select {
-		case <-t.rpcContext.Stopper.ShouldStop():
-			return nil
-		case <-raftIdleTimer.C:
-			raftIdleTimer.Read = true
-			return nil
-		case err := <-errCh:
-			return err
-		case req := <-ch:
-			err := stream.Send(req)
-			if req.Message.Type == raftpb.MsgSnap {
-				select {
-				case <-t.rpcContext.Stopper.ShouldStop():
-					return nil
-				case t.SnapshotStatusChan <- RaftSnapshotStatus{req, err}:
-				}
+// getPeer returns the peer registered for nodeID, if any.
+func (t *RaftTransport) getPeer(nodeID roachpb.NodeID) (*peer, bool) {
+	t.mu.Lock()
+	p, ok := t.mu.peers[nodeID]
+	t.mu.Unlock()
+	return p, ok
+}
 
-			}
-			if err != nil {
-				return err
-			}
-		}
+// removePeerIfCurrent removes p from the peers map, but only if it is still
+// the peer registered for nodeID; this guards against racing with a
+// RemovePeer/AddPeer pair that has already replaced it.
+func (t *RaftTransport) removePeerIfCurrent(nodeID roachpb.NodeID, p *peer) {
+	t.mu.Lock()
+	if t.mu.peers[nodeID] == p {
+		delete(t.mu.peers, nodeID)
 	}
+	t.mu.Unlock()
 }
 
-type errHandler func(error, roachpb.ReplicaDescriptor)
-
-// RaftSender is a wrapper around RaftTransport that provides an error
-// handler.
+// RaftSender is a wrapper around a Transport that provides the sending
+// half of the raft message API. It holds a Transport interface value
+// rather than a concrete *RaftTransport so that it works unmodified
+// against any Transport implementation.
 type RaftSender struct {
-	transport *RaftTransport
-	onError   errHandler
+	transport Transport
+	send      func(*RaftMessageRequest) bool
 }
 
-// MakeSender constructs a RaftSender with the provided error handler.
-func (t *RaftTransport) MakeSender(onError errHandler) RaftSender {
-	return RaftSender{transport: t, onError: onError}
+// MakeSender constructs a RaftSender.
+func (t *RaftTransport) MakeSender() RaftSender {
+	return RaftSender{transport: t, send: t.sendAsync}
+}
+
+// sendAsync looks up the peer registered for the recipient and hands it
+// req, returning false if there is no such peer (see AddPeer) or if the
+// peer's outgoing queue is full.
+func (t *RaftTransport) sendAsync(req *RaftMessageRequest) bool {
+	p, ok := t.getPeer(req.ToReplica.NodeID)
+	if !ok {
+		return false
+	}
+	return p.send(req)
 }
 
 // SendAsync sends a message to the recipient specified in the request. It
-// returns false if the outgoing queue is full and calls s.onError when the
-// recipient closes the stream.
+// returns false if the underlying Transport has no route to the recipient
+// or if that route's outgoing queue is full.
 func (s RaftSender) SendAsync(req *RaftMessageRequest) bool {
 	isHeartbeat := (req.Message.Type == raftpb.MsgHeartbeat ||
 		req.Message.Type == raftpb.MsgHeartbeatResp)
@@ -317,42 +376,5 @@ func (s RaftSender) SendAsync(req *RaftMessageRequest) bool {
 		// needs an explicit range ID.
 		panic("only heartbeat messages may be sent to range ID 0")
 	}
-	isSnap := req.Message.Type == raftpb.MsgSnap
-	toReplica := req.ToReplica
-	s.transport.mu.Lock()
-	// We use two queues; one will be used for snapshots, the other for all other
-	// traffic. This is done to prevent snapshots from blocking other traffic.
-	queues, ok := s.transport.mu.queues[isSnap]
-	if !ok {
-		queues = make(map[roachpb.ReplicaDescriptor]chan *RaftMessageRequest)
-		s.transport.mu.queues[isSnap] = queues
-	}
-	ch, ok := queues[toReplica]
-	if !ok {
-		ch = make(chan *RaftMessageRequest, raftSendBufferSize)
-		queues[toReplica] = ch
-	}
-	s.transport.mu.Unlock()
-
-	if !ok {
-		// Starting workers in a task prevents data races during shutdown.
-		if err := s.transport.rpcContext.Stopper.RunTask(func() {
-			s.transport.rpcContext.Stopper.RunWorker(func() {
-				s.onError(s.transport.processQueue(ch, toReplica), toReplica)
-
-				s.transport.mu.Lock()
-				delete(queues, toReplica)
-				s.transport.mu.Unlock()
-			})
-		}); err != nil {
-			s.onError(err, toReplica)
-		}
-	}
-
-	select {
-	case ch <- req:
-		return true
-	default:
-		return false
-	}
+	return s.send(req)
 }
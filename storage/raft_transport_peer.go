@@ -0,0 +1,533 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"net"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/retry"
+	"github.com/cockroachdb/cockroach/util/syncutil"
+	"github.com/cockroachdb/cockroach/util/timeutil"
+)
+
+// raftMsgClass partitions outbound raft traffic into independent pipelines
+// so that, for example, a burst of MsgApp to a slow follower cannot starve
+// that follower's heartbeats. Each class is carried on its own gRPC stream;
+// see peer.run.
+type raftMsgClass int
+
+const (
+	// raftAppClass carries MsgApp, MsgVote, MsgProp and everything else
+	// that isn't given its own class below.
+	raftAppClass raftMsgClass = iota
+	// raftHeartbeatClass carries MsgHeartbeat and MsgHeartbeatResp. It has a
+	// small buffer and never blocks: a full heartbeat queue drops the
+	// message rather than backing up behind append traffic, and a failed
+	// heartbeat send is logged rather than tearing down the peer.
+	raftHeartbeatClass
+	// raftSnapClass is MsgSnap's class. Unlike the two above, it is not
+	// carried on one of the peer's shared, long-lived streams: snapshots
+	// are dispatched to their own goroutine and their own connection by
+	// peer.sendSnapshot, so that they can never block, or be blocked by,
+	// append or heartbeat traffic.
+	raftSnapClass
+
+	// numStreamClasses is the number of classes multiplexed onto the
+	// peer's shared streams -- i.e. every class except raftSnapClass.
+	numStreamClasses = raftSnapClass
+)
+
+// raftSendBufferSizes gives the outgoing queue depth for each raftMsgClass,
+// including raftSnapClass's queue of snapshots awaiting dispatch.
+var raftSendBufferSizes = [raftSnapClass + 1]int{
+	raftAppClass:       100,
+	raftHeartbeatClass: 10,
+	raftSnapClass:      4,
+}
+
+// defaultSnapshotSendConcurrency bounds how many snapshots a single peer
+// will stream to its remote node at once, so that a burst of rebalances
+// doesn't saturate the NIC.
+const defaultSnapshotSendConcurrency = 1
+
+// raftPeerPauseThreshold is the number of consecutive non-heartbeat sends
+// dropped for a full queue before send pauses the peer, shedding load onto
+// it until run next reconnects and calls resume. A single dropped message
+// is routine backpressure; a run of them means the peer isn't draining.
+const raftPeerPauseThreshold = 3
+
+// classifyRaftMsg returns the raftMsgClass that req should be sent on.
+func classifyRaftMsg(req *RaftMessageRequest) raftMsgClass {
+	switch req.Message.Type {
+	case raftpb.MsgSnap:
+		return raftSnapClass
+	case raftpb.MsgHeartbeat, raftpb.MsgHeartbeatResp:
+		return raftHeartbeatClass
+	default:
+		return raftAppClass
+	}
+}
+
+// classErr pairs a raftMsgClass's stream error with the class it came from,
+// so that run can tell a dead heartbeat stream from a dead append stream.
+type classErr struct {
+	class raftMsgClass
+	err   error
+}
+
+// errPeerIdle is returned by run when it exits because the peer has gone
+// quiet for raftIdleTimeout, as opposed to a real connection failure. start
+// treats it as a signal to reconnect at once rather than tear the peer
+// down: an idle follower is normal, and losing the connection must not make
+// it permanently unreachable from this node.
+var errPeerIdle = errors.New("raft peer idle")
+
+// peer represents the outbound connection to a single remote node. It owns
+// the gRPC streams used to deliver raft messages to that node (one per
+// raftMsgClass except raftSnapClass, whose snapshots each get a connection
+// of their own), the channels those messages are queued on, and an explicit
+// start/pause/resume/stop lifecycle driven by
+// RaftTransport.AddPeer/RemovePeer rather than by the first call to
+// SendAsync.
+type peer struct {
+	nodeID    roachpb.NodeID
+	transport *RaftTransport
+
+	sendChs [numStreamClasses]chan *RaftMessageRequest
+	// snapshotCh queues snapshots awaiting dispatch by runSnapshots; unlike
+	// sendChs, it is never read by run.
+	snapshotCh chan *RaftMessageRequest
+	// quit is closed by stop to terminate run and runSnapshots, and stopped
+	// is closed by run once it has returned, so that stop can block until
+	// cleanup of the main loop is done.
+	quit    chan struct{}
+	stopped chan struct{}
+
+	// stats holds this peer's counters and gauges, surfaced through
+	// RaftTransport.Stats.
+	stats *peerStats
+
+	mu struct {
+		syncutil.Mutex
+		// replicas is the set of replicas on nodeID this peer has been
+		// asked to carry traffic for, recorded so that a broken connection
+		// can be attributed to every range it affects.
+		replicas map[roachpb.ReplicaDescriptor]struct{}
+		// paused peers silently drop outbound messages instead of queueing
+		// them; used to shed load onto a peer known to be unhealthy without
+		// tearing down and re-resolving its connection. Set automatically
+		// once consecutiveDrops reaches raftPeerPauseThreshold and cleared
+		// by resume once the peer reconnects; see send and run.
+		paused bool
+		// consecutiveDrops counts non-heartbeat sends dropped in a row
+		// because a queue was full, reset on the next successful send or by
+		// resume. It exists only to decide when to pause; see send.
+		consecutiveDrops int
+		// addrLookup is non-nil while an address resolution for nodeID is in
+		// flight, so that run and the concurrent sendSnapshot goroutines
+		// runSnapshots spawns don't each kick off their own redundant
+		// resolver calls; see resolveAddr.
+		addrLookup chan struct{}
+	}
+}
+
+// newPeer creates a peer for nodeID. The peer is inert until start is
+// called.
+func newPeer(t *RaftTransport, nodeID roachpb.NodeID) *peer {
+	p := &peer{
+		nodeID:     nodeID,
+		transport:  t,
+		snapshotCh: make(chan *RaftMessageRequest, raftSendBufferSizes[raftSnapClass]),
+		quit:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		stats:      &peerStats{metrics: &t.metrics},
+	}
+	for class := raftMsgClass(0); class < numStreamClasses; class++ {
+		p.sendChs[class] = make(chan *RaftMessageRequest, raftSendBufferSizes[class])
+	}
+	return p
+}
+
+// addReplica records toReplica as being carried by this peer.
+func (p *peer) addReplica(toReplica roachpb.ReplicaDescriptor) {
+	p.mu.Lock()
+	if p.mu.replicas == nil {
+		p.mu.replicas = make(map[roachpb.ReplicaDescriptor]struct{})
+	}
+	p.mu.replicas[toReplica] = struct{}{}
+	p.mu.Unlock()
+}
+
+// pause causes the peer to silently drop outbound messages rather than
+// queueing them for delivery. send calls this once consecutiveDrops
+// reaches raftPeerPauseThreshold.
+func (p *peer) pause() {
+	p.mu.Lock()
+	p.mu.paused = true
+	p.mu.Unlock()
+}
+
+// resume undoes the effect of pause and clears consecutiveDrops. run calls
+// this once a fresh connection is up, since a peer that's draining again is
+// no longer a candidate for load-shedding.
+func (p *peer) resume() {
+	p.mu.Lock()
+	p.mu.paused = false
+	p.mu.consecutiveDrops = 0
+	p.mu.Unlock()
+}
+
+// replicas returns a snapshot of the replicas this peer has been told it is
+// carrying traffic for.
+func (p *peer) replicas() []roachpb.ReplicaDescriptor {
+	p.mu.Lock()
+	replicas := make([]roachpb.ReplicaDescriptor, 0, len(p.mu.replicas))
+	for r := range p.mu.replicas {
+		replicas = append(replicas, r)
+	}
+	p.mu.Unlock()
+	return replicas
+}
+
+// notifyReplicasDown tells the transport's onPeerDownFunc handlers that
+// every replica this peer carries traffic for has become unreachable.
+func (p *peer) notifyReplicasDown() {
+	for _, r := range p.replicas() {
+		p.transport.notifyPeerDown(r)
+	}
+}
+
+// resolveAddr resolves this peer's nodeID to a network address, retrying
+// with backoff for nodes that aren't yet reachable via gossip (as in the
+// case of reconstituting a cluster from copied data or after a long
+// downtime). Once resolution has failed for more than one retry cycle,
+// onUnreachable (if non-nil) is called so that raft can be told about the
+// peer without waiting for resolution to give up entirely.
+//
+// Concurrent callers -- run and the sendSnapshot goroutines runSnapshots
+// spawns -- share a single in-flight resolution rather than each starting
+// their own.
+func (p *peer) resolveAddr(onUnreachable func()) (net.Addr, error) {
+	p.mu.Lock()
+	ch, ok := p.mu.addrLookup, p.mu.addrLookup != nil
+	if !ok {
+		ch = make(chan struct{})
+		p.mu.addrLookup = ch
+	}
+	p.mu.Unlock()
+	if ok {
+		select {
+		case <-ch:
+			return p.transport.resolver(p.nodeID)
+		case <-p.transport.rpcContext.Stopper.ShouldQuiesce():
+			return nil, errors.Errorf("address resolution for %s stopped before completion", p.nodeID)
+		}
+	}
+
+	defer func() {
+		p.mu.Lock()
+		p.mu.addrLookup = nil
+		p.mu.Unlock()
+	}()
+
+	opts := retry.Options{
+		InitialBackoff: InitialResolveBackoff,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Closer:         p.transport.rpcContext.Stopper.ShouldQuiesce(),
+	}
+	for r := retry.Start(opts); r.Next(); {
+		addr, err := p.transport.resolver(p.nodeID)
+		if err == nil {
+			close(ch)
+			if r.CurrentAttempt() > 0 {
+				log.Infof(context.TODO(), "address resolution for %s succeeded: %s", p.nodeID, addr)
+			}
+			return addr, nil
+		} else if r.CurrentAttempt() == 0 {
+			log.Warningf(context.TODO(), "failing address resolution for %s: %s", p.nodeID, err)
+		} else if r.CurrentAttempt() == 1 && onUnreachable != nil {
+			onUnreachable()
+		}
+	}
+	return nil, errors.Errorf("address resolution for %s stopped before completion", p.nodeID)
+}
+
+// send enqueues req for delivery on the stream appropriate to its message
+// class, returning false if the peer is paused or that stream's outgoing
+// queue is full. A non-heartbeat message dropped for a full queue notifies
+// the transport's onPeerDownFunc handlers, since raft should not keep
+// proposing into a queue that isn't draining; heartbeats, and every message
+// sent while the peer is paused, are dropped silently. raftPeerPauseThreshold
+// consecutive non-heartbeat drops pause the peer, shedding load onto it
+// until run reconnects and calls resume.
+func (p *peer) send(req *RaftMessageRequest) bool {
+	p.mu.Lock()
+	paused := p.mu.paused
+	p.mu.Unlock()
+	if paused {
+		p.stats.recordDrop()
+		return false
+	}
+	class := classifyRaftMsg(req)
+	ch := p.snapshotCh
+	if class != raftSnapClass {
+		ch = p.sendChs[class]
+	}
+	select {
+	case ch <- req:
+		if class != raftHeartbeatClass {
+			p.mu.Lock()
+			p.mu.consecutiveDrops = 0
+			p.mu.Unlock()
+		}
+		return true
+	default:
+		p.stats.recordDrop()
+		if class != raftHeartbeatClass {
+			p.transport.notifyPeerDown(req.ToReplica)
+			p.mu.Lock()
+			p.mu.consecutiveDrops++
+			pause := p.mu.consecutiveDrops >= raftPeerPauseThreshold
+			p.mu.Unlock()
+			if pause {
+				p.pause()
+			}
+		}
+		return false
+	}
+}
+
+// start launches the worker goroutine that resolves nodeID's address,
+// dials it, and drains sendChs onto the resulting streams, restarting run
+// whenever it exits because the peer merely idled out, along with the
+// runSnapshots worker. It returns immediately. A real connection failure is
+// logged, reported to raft via the transport's onPeerDownFunc handlers for
+// every replica this peer carries, and causes the peer to unregister itself
+// from its transport; stop's closing of p.quit also ends the loop, but
+// without reporting or unregistering anything.
+func (p *peer) start() {
+	if err := p.transport.rpcContext.Stopper.RunTask(func() {
+		p.transport.rpcContext.Stopper.RunWorker(p.runSnapshots)
+		p.transport.rpcContext.Stopper.RunWorker(func() {
+			defer close(p.stopped)
+			for {
+				err := p.run()
+				if err == nil {
+					return
+				}
+				if err == errPeerIdle {
+					continue
+				}
+				log.Warningf(context.TODO(), "raft peer %d exiting: %s", p.nodeID, err)
+				p.notifyReplicasDown()
+				p.transport.removePeerIfCurrent(p.nodeID, p)
+				return
+			}
+		})
+	}); err != nil {
+		close(p.stopped)
+	}
+}
+
+// runSnapshots drains snapshotCh, dispatching each snapshot to its own
+// goroutine and its own connection via sendSnapshot, bounded to at most
+// defaultSnapshotSendConcurrency concurrent transfers so that a burst of
+// rebalances can't saturate the NIC.
+func (p *peer) runSnapshots() {
+	sem := make(chan struct{}, defaultSnapshotSendConcurrency)
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-p.transport.rpcContext.Stopper.ShouldQuiesce():
+			return
+		case req := <-p.snapshotCh:
+			select {
+			case sem <- struct{}{}:
+			case <-p.quit:
+				return
+			case <-p.transport.rpcContext.Stopper.ShouldQuiesce():
+				return
+			}
+			if err := p.transport.rpcContext.Stopper.RunTask(func() {
+				p.transport.rpcContext.Stopper.RunWorker(func() {
+					defer func() { <-sem }()
+					p.sendSnapshot(req)
+				})
+			}); err != nil {
+				<-sem
+				return
+			}
+		}
+	}
+}
+
+// sendSnapshot transfers req's snapshot to this peer's node over a
+// dedicated connection and reports the outcome on
+// RaftTransport.SnapshotStatusChan.
+func (p *peer) sendSnapshot(req *RaftMessageRequest) {
+	start := timeutil.Now()
+	size, err := p.transferSnapshot(req)
+	dur := timeutil.Since(start)
+	if err == nil {
+		p.stats.recordSend(raftSnapClass, int(size))
+	} else {
+		p.stats.recordDrop()
+		p.transport.notifyPeerDown(req.ToReplica)
+	}
+
+	status := RaftSnapshotStatus{Req: req, Err: err, Size: size, Duration: dur}
+	select {
+	case <-p.transport.rpcContext.Stopper.ShouldQuiesce():
+	case p.transport.SnapshotStatusChan <- status:
+	}
+}
+
+// stop signals the peer's worker goroutines to exit and blocks until the
+// one driving run has done so. Messages still queued on sendChs and
+// snapshotCh are discarded.
+func (p *peer) stop() {
+	close(p.quit)
+	<-p.stopped
+}
+
+// run creates a client and opens one gRPC stream per streamed raftMsgClass
+// (app and heartbeat; snapshots go through sendSnapshot instead), then sends
+// messages from sendChs via the matching stream, exiting when the append
+// stream fails, when the peer idles out, or when stop is called. All
+// messages remaining in the queues at that point are lost. A failure of the
+// heartbeat stream alone does not end the peer; it is logged and the
+// heartbeat stream is reopened, and only a failure to reopen it ends run.
+// Idling out returns errPeerIdle rather than nil, so that start can tell an
+// idle peer -- which reconnects at once -- from one whose connection
+// actually failed.
+func (p *peer) run() error {
+	addr, err := p.resolveAddr(p.notifyReplicasDown)
+	if err != nil {
+		return err
+	}
+
+	conn, err := p.transport.rpcContext.GRPCDial(addr.String())
+	if err != nil {
+		return err
+	}
+	client := NewMultiRaftClient(conn)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var streams [numStreamClasses]MultiRaft_RaftMessageClient
+	for class := raftMsgClass(0); class < numStreamClasses; class++ {
+		stream, err := client.RaftMessage(ctx)
+		if err != nil {
+			return err
+		}
+		streams[class] = stream
+	}
+
+	errCh := make(chan classErr, numStreamClasses)
+
+	// Starting workers in a task prevents data races during shutdown.
+	if err := p.transport.rpcContext.Stopper.RunTask(func() {
+		for class := raftMsgClass(0); class < numStreamClasses; class++ {
+			class, stream := class, streams[class]
+			if class == raftHeartbeatClass {
+				p.runHeartbeatReader(stream, errCh)
+				continue
+			}
+			p.transport.rpcContext.Stopper.RunWorker(func() {
+				errCh <- classErr{class, stream.RecvMsg(new(RaftMessageResponse))}
+			})
+		}
+	}); err != nil {
+		return err
+	}
+
+	p.stats.setStreamUp(true)
+	defer p.stats.setStreamUp(false)
+
+	// A live connection means any load-shedding pause triggered by the
+	// previous connection's backlog (see send) no longer applies.
+	p.resume()
+
+	var raftIdleTimer timeutil.Timer
+	defer raftIdleTimer.Stop()
+	for {
+		raftIdleTimer.Reset(raftIdleTimeout)
+		select {
+		case <-p.quit:
+			return nil
+		case <-p.transport.rpcContext.Stopper.ShouldStop():
+			return nil
+		case <-raftIdleTimer.C:
+			raftIdleTimer.Read = true
+			return errPeerIdle
+		case ce := <-errCh:
+			if ce.class == raftHeartbeatClass {
+				log.Warningf(context.TODO(), "raft peer %d: heartbeat stream failed, reopening: %s", p.nodeID, ce.err)
+				stream, err := client.RaftMessage(ctx)
+				if err != nil {
+					log.Warningf(context.TODO(), "raft peer %d: failed to reopen heartbeat stream: %s", p.nodeID, err)
+					return err
+				}
+				streams[raftHeartbeatClass] = stream
+				if err := p.transport.rpcContext.Stopper.RunTask(func() {
+					p.runHeartbeatReader(stream, errCh)
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+			return ce.err
+		case req := <-p.sendChs[raftAppClass]:
+			if err := streams[raftAppClass].Send(req); err != nil {
+				return err
+			}
+			p.stats.recordSend(raftAppClass, req.Size())
+		case req := <-p.sendChs[raftHeartbeatClass]:
+			if err := streams[raftHeartbeatClass].Send(req); err != nil {
+				log.Warningf(context.TODO(), "raft peer %d: dropping heartbeat: %s", p.nodeID, err)
+				continue
+			}
+			p.stats.recordSend(raftHeartbeatClass, req.Size())
+		}
+	}
+}
+
+// runHeartbeatReader spawns a worker that drains stream in a loop rather
+// than reading it once, so that every ack can update the round-trip
+// latency EWMA. It reports the first receive error on errCh and returns;
+// run reopens the heartbeat stream and calls this again rather than
+// leaving heartbeats permanently unacknowledged for the life of the peer.
+func (p *peer) runHeartbeatReader(stream MultiRaft_RaftMessageClient, errCh chan<- classErr) {
+	p.transport.rpcContext.Stopper.RunWorker(func() {
+		for {
+			if err := stream.RecvMsg(new(RaftMessageResponse)); err != nil {
+				errCh <- classErr{raftHeartbeatClass, err}
+				return
+			}
+			p.stats.recordHeartbeatAck()
+		}
+	})
+}
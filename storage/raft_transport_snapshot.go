@@ -0,0 +1,263 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/uuid"
+)
+
+// snapshotChunkSize is the maximum number of snapshot data bytes carried by
+// a single SnapshotChunk message. 256KiB keeps any one gRPC message small
+// enough that a slow receiver can't stall the sender's flow control for
+// long, while still amortizing per-message overhead.
+const snapshotChunkSize = 256 << 10
+
+// transferSnapshot delivers req's snapshot to this peer's node over a
+// connection dedicated to this transfer, so that its size and duration
+// can't affect the shared append/heartbeat streams used by peer.run. It
+// returns the number of snapshot bytes sent.
+//
+// If the receiver answers the header with a non-zero resume offset,
+// transferSnapshot starts its chunk loop there. The UUID presented to the
+// receiver is assigned per RangeID/ToReplica rather than minted fresh on
+// every call -- see RaftTransport.snapshotUUID -- so a retried
+// transferSnapshot for the same destination reuses it. RaftSnapshot drops
+// its partial data when a connection fails, though (see pendingSnapshot),
+// so a retry after a dropped connection starts again from offset zero.
+func (p *peer) transferSnapshot(req *RaftMessageRequest) (int64, error) {
+	t := p.transport
+	addr, err := p.resolveAddr(p.notifyReplicasDown)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := t.rpcContext.GRPCDial(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	client := NewMultiRaftClient(conn)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.rpcContext.Stopper.ShouldQuiesce():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream, err := client.RaftSnapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	id := t.snapshotUUID(req.RangeID, req.ToReplica)
+	snap := req.Message.Snapshot
+	header := &SnapshotRequestHeader{
+		RangeID:     req.RangeID,
+		FromReplica: req.FromReplica,
+		ToReplica:   req.ToReplica,
+		Snapshot:    snap,
+		UUID:        id,
+		Size:        int64(snap.Size()),
+	}
+	if err := stream.Send(&SnapshotChunk{Header: header}); err != nil {
+		return 0, err
+	}
+
+	resp, err := stream.Recv()
+	if err != nil {
+		return 0, err
+	}
+	if resp.Status == SnapshotResponse_ERROR {
+		return 0, errors.Errorf("snapshot %s rejected by %s: %s", header.UUID, p.nodeID, resp.Message)
+	}
+
+	data := snap.Data
+	var sent int64
+	for offset := resp.ResumeOffset; offset < int64(len(data)); {
+		end := offset + snapshotChunkSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		chunk := &SnapshotChunk{
+			UUID: header.UUID,
+			Seq:  offset / snapshotChunkSize,
+			Data: data[offset:end],
+		}
+		if err := stream.Send(chunk); err != nil {
+			return sent, err
+		}
+		sent += end - offset
+		offset = end
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return sent, err
+	}
+	resp, err = stream.Recv()
+	if err != nil {
+		return sent, err
+	}
+	if resp.Status == SnapshotResponse_ERROR {
+		return sent, errors.Errorf("snapshot %s failed on %s: %s", header.UUID, p.nodeID, resp.Message)
+	}
+	// The transfer reached the receiver intact, so there is nothing left to
+	// resume; drop the UUID so a later, unrelated snapshot for the same
+	// RangeID/ToReplica starts a transfer of its own rather than appearing
+	// to resume this one.
+	t.clearSnapshotUUID(req.RangeID, req.ToReplica)
+	return sent, nil
+}
+
+// pendingSnapshot tracks the bytes received so far for a partially-received
+// snapshot, keyed by the sender's UUID. An entry lives only as long as the
+// RaftSnapshot call that created it: RaftSnapshot removes it on every exit,
+// including a failed receive, so a transfer whose connection drops
+// mid-transfer is restarted from scratch by the next attempt, not resumed.
+type pendingSnapshot struct {
+	header *SnapshotRequestHeader
+	data   []byte
+}
+
+// RaftSnapshot implements the receiving side of the dedicated snapshot RPC.
+// Unlike RaftMessage, each call is a single snapshot delivered over its own
+// connection: RaftSnapshot acknowledges the header (or NACKs it with a
+// resume offset, if it already holds a partial transfer for the same
+// UUID), reassembles the chunked payload, and dispatches the completed
+// snapshot to the handler registered for its destination store.
+func (t *RaftTransport) RaftSnapshot(stream MultiRaft_RaftSnapshotServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := first.Header
+	if header == nil {
+		return errors.New("expected snapshot header as first message")
+	}
+
+	t.mu.Lock()
+	handler, ok := t.mu.handlers[header.ToReplica.StoreID]
+	pending, resuming := t.mu.pendingSnapshots[header.UUID]
+	if !resuming {
+		pending = &pendingSnapshot{header: header, data: make([]byte, 0, header.Size)}
+		t.mu.pendingSnapshots[header.UUID] = pending
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		t.removePendingSnapshot(header.UUID)
+		return errors.Errorf(
+			"unable to accept snapshot from %+v: no store registered for %+v",
+			header.FromReplica, header.ToReplica)
+	}
+
+	if err := stream.Send(&SnapshotResponse{
+		Status:       SnapshotResponse_ACCEPTED,
+		ResumeOffset: int64(len(pending.data)),
+	}); err != nil {
+		t.removePendingSnapshot(header.UUID)
+		return err
+	}
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.removePendingSnapshot(header.UUID)
+			return err
+		}
+		pending.data = append(pending.data, chunk.Data...)
+
+		select {
+		case <-t.rpcContext.Stopper.ShouldQuiesce():
+			t.removePendingSnapshot(header.UUID)
+			return errors.Errorf("snapshot %s aborted: node is quiescing", header.UUID)
+		default:
+		}
+	}
+
+	t.removePendingSnapshot(header.UUID)
+
+	snap := header.Snapshot
+	snap.Data = pending.data
+	req := &RaftMessageRequest{
+		RangeID:     header.RangeID,
+		FromReplica: header.FromReplica,
+		ToReplica:   header.ToReplica,
+	}
+	req.Message.Snapshot = snap
+
+	if err := handler(req); err != nil {
+		return stream.Send(&SnapshotResponse{
+			Status:  SnapshotResponse_ERROR,
+			Message: err.Error(),
+		})
+	}
+	return stream.Send(&SnapshotResponse{Status: SnapshotResponse_ACCEPTED})
+}
+
+// removePendingSnapshot discards any partial-transfer state kept for uuid.
+func (t *RaftTransport) removePendingSnapshot(id uuid.UUID) {
+	t.mu.Lock()
+	delete(t.mu.pendingSnapshots, id)
+	t.mu.Unlock()
+}
+
+// snapshotTransferKey identifies a single logical snapshot transfer -- one
+// range being caught up to one destination replica -- independent of how
+// many times transferSnapshot has to be retried to get it there.
+type snapshotTransferKey struct {
+	rangeID   roachpb.RangeID
+	toReplica roachpb.ReplicaDescriptor
+}
+
+// snapshotUUID returns the UUID that transferSnapshot should present to the
+// receiver for the transfer identified by rangeID/toReplica, minting one on
+// first use and returning the same one on every later call for the same
+// key. A retried transfer for the same key thus presents the same UUID to
+// RaftSnapshot's pendingSnapshots lookup; see pendingSnapshot for how long
+// the receiver keeps partial data under it.
+func (t *RaftTransport) snapshotUUID(rangeID roachpb.RangeID, toReplica roachpb.ReplicaDescriptor) uuid.UUID {
+	key := snapshotTransferKey{rangeID: rangeID, toReplica: toReplica}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.mu.snapshotUUIDs[key]; ok {
+		return id
+	}
+	id := uuid.NewV4()
+	t.mu.snapshotUUIDs[key] = id
+	return id
+}
+
+// clearSnapshotUUID discards the UUID assigned to the transfer identified
+// by rangeID/toReplica, once that transfer has completed. A later snapshot
+// for the same range/destination is unrelated and gets a UUID of its own.
+func (t *RaftTransport) clearSnapshotUUID(rangeID roachpb.RangeID, toReplica roachpb.ReplicaDescriptor) {
+	key := snapshotTransferKey{rangeID: rangeID, toReplica: toReplica}
+	t.mu.Lock()
+	delete(t.mu.snapshotUUIDs, key)
+	t.mu.Unlock()
+}
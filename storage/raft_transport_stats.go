@@ -0,0 +1,241 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+	"github.com/cockroachdb/cockroach/util/metric"
+	"github.com/cockroachdb/cockroach/util/syncutil"
+	"github.com/cockroachdb/cockroach/util/timeutil"
+)
+
+// rttEWMAAlpha weights the most recent heartbeat round-trip sample against
+// the running average when updating a peer's latency estimate.
+const rttEWMAAlpha = 0.3
+
+// peerStats holds the live counters and gauges for a single peer. The
+// integer counters are updated atomically; the heartbeat bookkeeping used
+// to compute the latency EWMA is small enough to guard with mu instead.
+// Sends and drops are also folded into the owning transport's aggregate
+// metrics, via the metrics field, so that per-node dashboards don't have to
+// sum every peer's PeerStats themselves.
+type peerStats struct {
+	metrics *transportMetrics
+
+	msgsSent      int64
+	msgsRcvd      int64
+	bytesSent     int64
+	msgsDropped   int64
+	lastSendNanos int64
+	streamUp      int32
+
+	mu struct {
+		syncutil.Mutex
+		heartbeatSentAt time.Time
+		rttEWMA         time.Duration
+	}
+}
+
+// recordSend accounts for a message of size bytes successfully handed to
+// the gRPC stream for class.
+func (s *peerStats) recordSend(class raftMsgClass, size int) {
+	atomic.AddInt64(&s.msgsSent, 1)
+	atomic.AddInt64(&s.bytesSent, int64(size))
+	atomic.StoreInt64(&s.lastSendNanos, timeutil.Now().UnixNano())
+	if class == raftHeartbeatClass {
+		s.mu.Lock()
+		s.mu.heartbeatSentAt = timeutil.Now()
+		s.mu.Unlock()
+	}
+	s.metrics.MsgsSent.Inc(1)
+	s.metrics.BytesSent.Inc(int64(size))
+}
+
+// recordDrop accounts for a message that was never queued, either because
+// the peer is paused or because its outgoing queue was full.
+func (s *peerStats) recordDrop() {
+	atomic.AddInt64(&s.msgsDropped, 1)
+	s.metrics.MsgsDropped.Inc(1)
+}
+
+// recordHeartbeatAck updates the round-trip latency EWMA against the most
+// recently recorded heartbeat send and counts the ack as a received
+// message.
+func (s *peerStats) recordHeartbeatAck() {
+	now := timeutil.Now()
+	s.mu.Lock()
+	if sentAt := s.mu.heartbeatSentAt; !sentAt.IsZero() {
+		rtt := now.Sub(sentAt)
+		if s.mu.rttEWMA == 0 {
+			s.mu.rttEWMA = rtt
+		} else {
+			s.mu.rttEWMA = time.Duration(rttEWMAAlpha*float64(rtt) + (1-rttEWMAAlpha)*float64(s.mu.rttEWMA))
+		}
+	}
+	s.mu.Unlock()
+	atomic.AddInt64(&s.msgsRcvd, 1)
+}
+
+// setStreamUp records whether the peer currently has a live append stream.
+func (s *peerStats) setStreamUp(up bool) {
+	var v int32
+	if up {
+		v = 1
+	}
+	atomic.StoreInt32(&s.streamUp, v)
+}
+
+// PeerStats is a point-in-time snapshot of a single peer's counters and
+// gauges, returned as part of RaftTransport.Stats. It has no BytesRcvd: a
+// peer represents this node's outbound connection to nodeID, and the
+// RaftMessage server loop that receives inbound traffic has no per-peer
+// object to attribute received bytes to, only the FromReplica on each
+// request -- see ServerStats for received traffic, which is tallied there
+// as a node-wide aggregate instead.
+type PeerStats struct {
+	NodeID      roachpb.NodeID
+	MsgsSent    int64
+	MsgsRcvd    int64
+	BytesSent   int64
+	MsgsDropped int64
+	QueueDepth  int
+	StreamUp    bool
+	LastSend    time.Time
+	RTTEWMA     time.Duration
+}
+
+// snapshotStats returns a point-in-time snapshot of p's counters and
+// gauges.
+func (p *peer) snapshotStats() PeerStats {
+	p.stats.mu.Lock()
+	rtt := p.stats.mu.rttEWMA
+	p.stats.mu.Unlock()
+
+	depth := len(p.snapshotCh)
+	for class := range p.sendChs {
+		depth += len(p.sendChs[class])
+	}
+
+	var lastSend time.Time
+	if nanos := atomic.LoadInt64(&p.stats.lastSendNanos); nanos != 0 {
+		lastSend = timeutil.Unix(0, nanos)
+	}
+
+	return PeerStats{
+		NodeID:      p.nodeID,
+		MsgsSent:    atomic.LoadInt64(&p.stats.msgsSent),
+		MsgsRcvd:    atomic.LoadInt64(&p.stats.msgsRcvd),
+		BytesSent:   atomic.LoadInt64(&p.stats.bytesSent),
+		MsgsDropped: atomic.LoadInt64(&p.stats.msgsDropped),
+		QueueDepth:  depth,
+		StreamUp:    atomic.LoadInt32(&p.stats.streamUp) == 1,
+		LastSend:    lastSend,
+		RTTEWMA:     rtt,
+	}
+}
+
+// LeaderStats aggregates the outbound per-peer stats across all of this
+// node's peers, mirroring the split etcd's rafthttp exposes as
+// LeaderStats. It is only meaningful while this node holds raft leadership
+// for at least one range, approximated here by this node having at least
+// one active outbound peer.
+type LeaderStats struct {
+	MsgsSent    int64
+	BytesSent   int64
+	MsgsDropped int64
+	Followers   map[roachpb.NodeID]PeerStats
+}
+
+// ServerStats aggregates this node's inbound raft traffic, mirroring the
+// split etcd's rafthttp exposes as ServerStats.
+type ServerStats struct {
+	MsgsRcvd  int64
+	BytesRcvd int64
+}
+
+// Stats is a point-in-time snapshot of RaftTransport's per-peer and
+// aggregate counters and gauges, returned by RaftTransport.Stats.
+type Stats struct {
+	Leader LeaderStats
+	Server ServerStats
+}
+
+// Stats returns a point-in-time snapshot of this transport's counters and
+// gauges, split the way etcd splits LeaderStats (this node as sender) from
+// ServerStats (this node as receiver).
+func (t *RaftTransport) Stats() Stats {
+	t.mu.Lock()
+	peers := make([]*peer, 0, len(t.mu.peers))
+	for _, p := range t.mu.peers {
+		peers = append(peers, p)
+	}
+	t.mu.Unlock()
+
+	stats := Stats{
+		Leader: LeaderStats{Followers: make(map[roachpb.NodeID]PeerStats, len(peers))},
+		Server: ServerStats{
+			MsgsRcvd:  atomic.LoadInt64(&t.serverMsgsRcvd),
+			BytesRcvd: atomic.LoadInt64(&t.serverBytesRcvd),
+		},
+	}
+
+	var queueDepth int64
+	for _, p := range peers {
+		ps := p.snapshotStats()
+		stats.Leader.Followers[p.nodeID] = ps
+		stats.Leader.MsgsSent += ps.MsgsSent
+		stats.Leader.BytesSent += ps.BytesSent
+		stats.Leader.MsgsDropped += ps.MsgsDropped
+		queueDepth += int64(ps.QueueDepth)
+	}
+	t.metrics.QueueDepth.Update(queueDepth)
+
+	return stats
+}
+
+// transportMetrics holds the counters and gauges registered with the
+// node's metric.Registry so operators can chart follower lag per node.
+type transportMetrics struct {
+	MsgsSent    *metric.Counter
+	MsgsRcvd    *metric.Counter
+	BytesSent   *metric.Counter
+	BytesRcvd   *metric.Counter
+	MsgsDropped *metric.Counter
+	QueueDepth  *metric.Gauge
+}
+
+func makeTransportMetrics(registry *metric.Registry) transportMetrics {
+	m := transportMetrics{
+		MsgsSent:    metric.NewCounter("raft.transport.sent"),
+		MsgsRcvd:    metric.NewCounter("raft.transport.rcvd"),
+		BytesSent:   metric.NewCounter("raft.transport.bytes-sent"),
+		BytesRcvd:   metric.NewCounter("raft.transport.bytes-rcvd"),
+		MsgsDropped: metric.NewCounter("raft.transport.dropped"),
+		QueueDepth:  metric.NewGauge("raft.transport.queue-depth"),
+	}
+	if registry != nil {
+		registry.AddMetric(m.MsgsSent)
+		registry.AddMetric(m.MsgsRcvd)
+		registry.AddMetric(m.BytesSent)
+		registry.AddMetric(m.BytesRcvd)
+		registry.AddMetric(m.MsgsDropped)
+		registry.AddMetric(m.QueueDepth)
+	}
+	return m
+}
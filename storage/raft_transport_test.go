@@ -0,0 +1,197 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/pkg/errors"
+
+	"github.com/cockroachdb/cockroach/roachpb"
+)
+
+func TestClassifyRaftMsg(t *testing.T) {
+	testCases := []struct {
+		typ  raftpb.MessageType
+		want raftMsgClass
+	}{
+		{raftpb.MsgSnap, raftSnapClass},
+		{raftpb.MsgHeartbeat, raftHeartbeatClass},
+		{raftpb.MsgHeartbeatResp, raftHeartbeatClass},
+		{raftpb.MsgApp, raftAppClass},
+		{raftpb.MsgVote, raftAppClass},
+	}
+	for _, c := range testCases {
+		req := &RaftMessageRequest{Message: raftpb.Message{Type: c.typ}}
+		if got := classifyRaftMsg(req); got != c.want {
+			t.Errorf("classifyRaftMsg(%s) = %d, want %d", c.typ, got, c.want)
+		}
+	}
+}
+
+func TestInMemTransportSendAndReceive(t *testing.T) {
+	network := NewInMemNetwork()
+	sender := network.NewTransport(1)
+	receiver := network.NewTransport(2)
+
+	recvd := make(chan *RaftMessageRequest, 1)
+	receiver.Listen(1, func(req *RaftMessageRequest) error {
+		recvd <- req
+		return nil
+	}, func(roachpb.ReplicaDescriptor) {})
+
+	req := &RaftMessageRequest{
+		RangeID: 7,
+		ToReplica: roachpb.ReplicaDescriptor{
+			NodeID:  2,
+			StoreID: 1,
+		},
+		Message: raftpb.Message{Type: raftpb.MsgApp},
+	}
+	if !sender.MakeSender().SendAsync(req) {
+		t.Fatal("SendAsync returned false for a reachable, listening destination")
+	}
+
+	select {
+	case got := <-recvd:
+		if got.RangeID != req.RangeID {
+			t.Errorf("got RangeID %d, want %d", got.RangeID, req.RangeID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+}
+
+func TestInMemTransportSendUnreachable(t *testing.T) {
+	network := NewInMemNetwork()
+	sender := network.NewTransport(1)
+
+	req := &RaftMessageRequest{
+		RangeID:   1,
+		ToReplica: roachpb.ReplicaDescriptor{NodeID: 2, StoreID: 1},
+	}
+	if sender.MakeSender().SendAsync(req) {
+		t.Fatal("SendAsync returned true for a destination with no registered transport")
+	}
+}
+
+func TestInMemTransportSendNoHandler(t *testing.T) {
+	network := NewInMemNetwork()
+	sender := network.NewTransport(1)
+	network.NewTransport(2)
+
+	req := &RaftMessageRequest{
+		RangeID:   1,
+		ToReplica: roachpb.ReplicaDescriptor{NodeID: 2, StoreID: 1},
+	}
+	if sender.MakeSender().SendAsync(req) {
+		t.Fatal("SendAsync returned true for a destination with no registered handler")
+	}
+}
+
+// TestInMemTransportNotifiesSenderOnHandlerError verifies that a handler
+// error is reported to the sending node's onPeerDown handlers, not the
+// receiving node's own -- a failed delivery means the sender can't reach
+// the destination, which says nothing about whether the destination can
+// reach itself.
+func TestInMemTransportNotifiesSenderOnHandlerError(t *testing.T) {
+	network := NewInMemNetwork()
+	sender := network.NewTransport(1)
+	receiver := network.NewTransport(2)
+
+	senderDown := make(chan roachpb.ReplicaDescriptor, 1)
+	receiverDown := make(chan roachpb.ReplicaDescriptor, 1)
+	sender.Listen(1, func(*RaftMessageRequest) error { return nil }, func(r roachpb.ReplicaDescriptor) {
+		senderDown <- r
+	})
+	receiver.Listen(1, func(*RaftMessageRequest) error {
+		return errors.New("boom")
+	}, func(r roachpb.ReplicaDescriptor) {
+		receiverDown <- r
+	})
+
+	toReplica := roachpb.ReplicaDescriptor{NodeID: 2, StoreID: 1}
+	req := &RaftMessageRequest{ToReplica: toReplica, Message: raftpb.Message{Type: raftpb.MsgApp}}
+	if !sender.MakeSender().SendAsync(req) {
+		t.Fatal("SendAsync returned false unexpectedly")
+	}
+
+	select {
+	case got := <-senderDown:
+		if got != toReplica {
+			t.Errorf("got %+v, want %+v", got, toReplica)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the sender's onPeerDown to fire")
+	}
+
+	select {
+	case <-receiverDown:
+		t.Fatal("receiver's onPeerDown must not fire for its own handler's error")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestPeerSendPausesAfterRepeatedDrops verifies that send sheds load onto a
+// peer whose queue stays full across raftPeerPauseThreshold consecutive
+// attempts, and that resume (as run calls once reconnected) undoes it.
+func TestPeerSendPausesAfterRepeatedDrops(t *testing.T) {
+	tr := NewRaftTransport(nil, nil, nil, nil)
+	down := make(chan roachpb.ReplicaDescriptor, 16)
+	tr.Listen(1, func(*RaftMessageRequest) error { return nil }, func(r roachpb.ReplicaDescriptor) {
+		down <- r
+	})
+
+	p := newPeer(tr, 5)
+	toReplica := roachpb.ReplicaDescriptor{NodeID: 5, StoreID: 1}
+	req := &RaftMessageRequest{ToReplica: toReplica, Message: raftpb.Message{Type: raftpb.MsgSnap}}
+
+	for i := 0; i < cap(p.snapshotCh); i++ {
+		if !p.send(req) {
+			t.Fatalf("send %d: queue should not be full yet", i)
+		}
+	}
+
+	for i := 0; i < raftPeerPauseThreshold; i++ {
+		if p.send(req) {
+			t.Fatalf("send: expected drop with a full queue")
+		}
+		select {
+		case <-down:
+		case <-time.After(time.Second):
+			t.Fatal("expected notifyPeerDown on a dropped send")
+		}
+	}
+
+	p.mu.Lock()
+	paused := p.mu.paused
+	p.mu.Unlock()
+	if !paused {
+		t.Fatal("expected the peer to pause after repeated drops")
+	}
+
+	<-p.snapshotCh
+	if p.send(req) {
+		t.Fatal("expected a paused peer to drop sends even with a free queue slot")
+	}
+
+	p.resume()
+	if !p.send(req) {
+		t.Fatal("expected a resumed peer to queue again")
+	}
+}